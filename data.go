@@ -3,29 +3,48 @@ package main
 import (
 	"compress/bzip2"
 	"encoding/csv"
+	"encoding/hex"
 	"io"
 	"os"
-	"strconv"
-	"strings"
 
-	"github.com/golang/geo/s2"
 	"github.com/pkg/errors"
 )
 
+// featureReader is implemented by every ingestion source convert knows how
+// to read: the bespoke tab-separated WKT CSV, ESRI shapefiles, and the same
+// CSV layout with hex-encoded WKB/EWKB in place of WKT.
+type featureReader interface {
+	Next() (road, bool)
+	Close()
+}
+
+// makeFeatureReader builds the featureReader for the given format, one of
+// "wkt" (the original bespoke CSV), "shp" (an ESRI shapefile), or "wkb" (a
+// CSV whose geometry column is hex-encoded WKB/EWKB instead of WKT).
+func makeFeatureReader(format, path string) (featureReader, error) {
+	switch format {
+	case ``, `wkt`:
+		return makeRoadReader(path)
+	case `shp`:
+		return makeShapefileReader(path)
+	case `wkb`:
+		return makeWKBReader(path)
+	default:
+		return nil, errors.Errorf("unknown ingestion format: %s", format)
+	}
+}
+
+type road struct {
+	idx  int
+	name string
+	geom Geometry
+}
+
 type roadReader struct {
 	i       int
 	f       *os.File
 	r       *csv.Reader
 	skipped int
-
-	buf []s2.LatLng
-}
-
-type road struct {
-	idx      int
-	name     string
-	geometry string
-	lls      []s2.LatLng
 }
 
 func makeRoadReader(path string) (*roadReader, error) {
@@ -45,7 +64,6 @@ func (rr *roadReader) Close() {
 }
 
 func (rr *roadReader) Next() (road, bool) {
-	var linestringOrig, name string
 	for {
 		parts, err := rr.r.Read()
 		if err == io.EOF {
@@ -53,41 +71,59 @@ func (rr *roadReader) Next() (road, bool) {
 		} else if err != nil {
 			panic(err)
 		}
-		linestringOrig, name = parts[0], parts[2]
-		if strings.HasPrefix(linestringOrig, `MULTILINESTRING`) {
+		wkt, name := parts[0], parts[2]
+		geom, err := parseWKT(wkt)
+		if err != nil {
 			rr.skipped++
 			continue
 		}
-		break
+		r := road{idx: rr.i, name: name, geom: geom}
+		rr.i++
+		return r, true
 	}
-	linestring := strings.TrimPrefix(linestringOrig, `LINESTRING (`)
-	linestring = strings.TrimSuffix(linestring, `)`)
+}
 
-	rr.buf = rr.buf[:0]
-	for len(linestring) > 0 {
-		var llRaw string
-		if i := strings.IndexByte(linestring, ','); i == -1 {
-			llRaw, linestring = linestring, linestring[:0]
-		} else {
-			llRaw, linestring = linestring[:i], linestring[i+1:]
-		}
-		i := strings.IndexByte(llRaw, ' ')
-		lng, err := strconv.ParseFloat(llRaw[:i], 64)
-		if err != nil {
-			panic(errors.Wrapf(err, "invalid linestring: %s", linestringOrig))
-		}
-		lat, err := strconv.ParseFloat(llRaw[i+1:], 64)
-		if err != nil {
-			panic(errors.Wrapf(err, "invalid linestring: %s", linestringOrig))
-		}
-		rr.buf = append(rr.buf, s2.LatLngFromDegrees(lat, lng))
+// wkbReader ingests the same tab-separated CSV layout as roadReader, except
+// the geometry column is hex-encoded WKB/EWKB rather than WKT.
+type wkbReader struct {
+	i int
+	f *os.File
+	r *csv.Reader
+}
+
+func makeWKBReader(path string) (*wkbReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening %s", path)
+	}
+	r := csv.NewReader(bzip2.NewReader(f))
+	r.FieldsPerRecord = 5
+	r.Comma = '\t'
+	r.ReuseRecord = true
+	return &wkbReader{f: f, r: r}, nil
+}
+
+func (wr *wkbReader) Close() {
+	wr.f.Close()
+}
+
+func (wr *wkbReader) Next() (road, bool) {
+	parts, err := wr.r.Read()
+	if err == io.EOF {
+		return road{}, false
+	} else if err != nil {
+		panic(err)
+	}
+	hexWKB, name := parts[0], parts[2]
+	b, err := hex.DecodeString(hexWKB)
+	if err != nil {
+		panic(errors.Wrapf(err, "invalid hex WKB: %s", hexWKB))
 	}
-	r := road{
-		idx:      rr.i,
-		name:     name,
-		geometry: linestringOrig,
-		lls:      rr.buf,
+	geom, err := parseWKB(b)
+	if err != nil {
+		panic(errors.Wrapf(err, "invalid WKB: %s", hexWKB))
 	}
-	rr.i++
+	r := road{idx: wr.i, name: name, geom: geom}
+	wr.i++
 	return r, true
 }
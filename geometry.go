@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"strings"
+
+	"github.com/golang/geo/s2"
+	"github.com/pkg/errors"
+)
+
+// Geometry is implemented by every ingestion format this tool knows how to
+// read (the bespoke WKT CSV, ESRI shapefiles, and raw WKB/EWKB), so convert
+// can treat them uniformly.
+type Geometry interface {
+	// Regions returns one s2.Region per sub-geometry, so a MULTILINESTRING
+	// or MULTIPOLYGON indexes all of its parts under the same feature id
+	// instead of being dropped or collapsed into one.
+	Regions() []s2.Region
+	// Center returns a representative point for the geometry, used as the
+	// query center when the feature is read back by queryReader.
+	Center() s2.LatLng
+	// WKB returns the geometry encoded as (E)WKB, for hex-encoding into
+	// table.csv so downstream PostGIS loads can decode(..., 'hex')::geometry
+	// directly.
+	WKB() []byte
+}
+
+// parsedGeometry is the Geometry implementation shared by every ingestion
+// path; only how regions/center/wkb get populated differs.
+type parsedGeometry struct {
+	regions []s2.Region
+	center  s2.LatLng
+	wkb     []byte
+}
+
+func (g *parsedGeometry) Regions() []s2.Region { return g.regions }
+func (g *parsedGeometry) Center() s2.LatLng    { return g.center }
+func (g *parsedGeometry) WKB() []byte          { return g.wkb }
+
+// parseWKT parses a WKT LINESTRING or MULTILINESTRING, the two shapes
+// present in the OSM road extracts this tool was built against.
+func parseWKT(s string) (Geometry, error) {
+	switch {
+	case strings.HasPrefix(s, `MULTILINESTRING (`):
+		return parseMultiLineStringWKT(s)
+	case strings.HasPrefix(s, `LINESTRING (`):
+		return parseLineStringWKT(s)
+	default:
+		return nil, errors.Errorf("unsupported WKT geometry: %s", s)
+	}
+}
+
+func parseLineStringWKT(s string) (Geometry, error) {
+	body := strings.TrimSuffix(strings.TrimPrefix(s, `LINESTRING (`), `)`)
+	lls, err := parseLatLngsWKT(body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid linestring: %s", s)
+	}
+	return &parsedGeometry{
+		regions: []s2.Region{s2.PolylineFromLatLngs(lls)},
+		center:  lls[0],
+		wkb:     encodeLineStringWKB(lls),
+	}, nil
+}
+
+func parseMultiLineStringWKT(s string) (Geometry, error) {
+	body := strings.TrimSuffix(strings.TrimPrefix(s, `MULTILINESTRING (`), `)`)
+	var parts [][]s2.LatLng
+	for _, group := range splitTopLevelGroups(body) {
+		lls, err := parseLatLngsWKT(strings.TrimSuffix(strings.TrimPrefix(group, `(`), `)`))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid multilinestring: %s", s)
+		}
+		parts = append(parts, lls)
+	}
+	g := &parsedGeometry{center: parts[0][0], wkb: encodeMultiLineStringWKB(parts)}
+	for _, lls := range parts {
+		g.regions = append(g.regions, s2.PolylineFromLatLngs(lls))
+	}
+	return g, nil
+}
+
+// splitTopLevelGroups splits "(a, b), (c, d)" into ["(a, b)", "(c, d)"],
+// i.e. on commas outside of any parens.
+func splitTopLevelGroups(s string) []string {
+	var groups []string
+	depth, start := 0, 0
+	for i, r := range s {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				groups = append(groups, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	groups = append(groups, strings.TrimSpace(s[start:]))
+	return groups
+}
+
+func parseLatLngsWKT(s string) ([]s2.LatLng, error) {
+	var lls []s2.LatLng
+	for len(s) > 0 {
+		var llRaw string
+		if i := strings.IndexByte(s, ','); i == -1 {
+			llRaw, s = s, s[:0]
+		} else {
+			llRaw, s = s[:i], s[i+1:]
+		}
+		llRaw = strings.TrimSpace(llRaw)
+		i := strings.IndexByte(llRaw, ' ')
+		if i == -1 {
+			return nil, errors.Errorf("invalid point: %q", llRaw)
+		}
+		lng, err := strconv.ParseFloat(llRaw[:i], 64)
+		if err != nil {
+			return nil, err
+		}
+		lat, err := strconv.ParseFloat(llRaw[i+1:], 64)
+		if err != nil {
+			return nil, err
+		}
+		lls = append(lls, s2.LatLngFromDegrees(lat, lng))
+	}
+	return lls, nil
+}
+
+// closeRing drops the trailing point of a WKB/shapefile ring when it's just
+// a repeat of the first point; s2.Loop represents rings without the closing
+// duplicate.
+func closeRing(lls []s2.LatLng) []s2.LatLng {
+	if len(lls) > 1 && lls[0] == lls[len(lls)-1] {
+		return lls[:len(lls)-1]
+	}
+	return lls
+}
+
+func loopFromRing(lls []s2.LatLng) *s2.Loop {
+	lls = closeRing(lls)
+	pts := make([]s2.Point, len(lls))
+	for i, ll := range lls {
+		pts[i] = s2.PointFromLatLng(ll)
+	}
+	loop := s2.LoopFromPoints(pts)
+	// Shapefile and WKB rings may wind either direction (most commonly
+	// clockwise exteriors), but s2.LoopFromPoints doesn't orient them; a
+	// clockwise exterior would otherwise be read as its near-global
+	// complement. Normalize so each loop encloses the smaller of the two
+	// regions its points describe.
+	loop.Normalize()
+	return loop
+}
+
+// polygonFromRings builds a single s2.Polygon region (exterior ring plus any
+// holes) and picks the first vertex of the exterior ring as its center.
+func polygonFromRings(rings [][]s2.LatLng) (*s2.Polygon, s2.LatLng) {
+	loops := make([]*s2.Loop, len(rings))
+	for i, ring := range rings {
+		loops[i] = loopFromRing(ring)
+	}
+	return s2.PolygonFromLoops(loops), rings[0][0]
+}
+
+// WKB/EWKB decoding. EWKB is PostGIS's extension of the OGC WKB spec that
+// adds an optional leading SRID, flagged by a high bit on the geometry type.
+
+type wkbByteOrder byte
+
+const (
+	wkbBigEndian    wkbByteOrder = 0
+	wkbLittleEndian wkbByteOrder = 1
+)
+
+type wkbGeometryType uint32
+
+const (
+	wkbPoint              wkbGeometryType = 1
+	wkbLineString         wkbGeometryType = 2
+	wkbPolygon            wkbGeometryType = 3
+	wkbMultiPoint         wkbGeometryType = 4
+	wkbMultiLineString    wkbGeometryType = 5
+	wkbMultiPolygon       wkbGeometryType = 6
+	wkbGeometryCollection wkbGeometryType = 7
+
+	wkbSRIDFlag = 0x20000000
+)
+
+// parseWKB parses a WKB or EWKB blob into a Geometry, yielding one
+// s2.Region per sub-geometry for MultiPoint/MultiLineString/MultiPolygon/
+// GeometryCollection.
+func parseWKB(b []byte) (Geometry, error) {
+	regions, center, err := parseWKBGeometry(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	return &parsedGeometry{regions: regions, center: center, wkb: b}, nil
+}
+
+func parseWKBGeometry(r *bytes.Reader) ([]s2.Region, s2.LatLng, error) {
+	var orderByte byte
+	if err := binary.Read(r, binary.LittleEndian, &orderByte); err != nil {
+		return nil, s2.LatLng{}, errors.Wrap(err, "reading byte order")
+	}
+	order := binary.ByteOrder(binary.LittleEndian)
+	if wkbByteOrder(orderByte) == wkbBigEndian {
+		order = binary.BigEndian
+	}
+	var rawType uint32
+	if err := binary.Read(r, order, &rawType); err != nil {
+		return nil, s2.LatLng{}, errors.Wrap(err, "reading geometry type")
+	}
+	if rawType&wkbSRIDFlag != 0 {
+		var srid uint32
+		if err := binary.Read(r, order, &srid); err != nil {
+			return nil, s2.LatLng{}, errors.Wrap(err, "reading SRID")
+		}
+		rawType &^= wkbSRIDFlag
+	}
+	switch wkbGeometryType(rawType) {
+	case wkbPoint:
+		ll, err := readWKBPoint(r, order)
+		if err != nil {
+			return nil, s2.LatLng{}, err
+		}
+		return []s2.Region{s2.PointFromLatLng(ll)}, ll, nil
+	case wkbLineString:
+		lls, err := readWKBPoints(r, order)
+		if err != nil {
+			return nil, s2.LatLng{}, err
+		}
+		return []s2.Region{s2.PolylineFromLatLngs(lls)}, lls[0], nil
+	case wkbPolygon:
+		rings, err := readWKBRings(r, order)
+		if err != nil {
+			return nil, s2.LatLng{}, err
+		}
+		poly, center := polygonFromRings(rings)
+		return []s2.Region{poly}, center, nil
+	case wkbMultiPoint, wkbMultiLineString, wkbMultiPolygon, wkbGeometryCollection:
+		var n uint32
+		if err := binary.Read(r, order, &n); err != nil {
+			return nil, s2.LatLng{}, errors.Wrap(err, "reading sub-geometry count")
+		}
+		var regions []s2.Region
+		var center s2.LatLng
+		for i := uint32(0); i < n; i++ {
+			subRegions, subCenter, err := parseWKBGeometry(r)
+			if err != nil {
+				return nil, s2.LatLng{}, errors.Wrapf(err, "sub-geometry %d", i)
+			}
+			if i == 0 {
+				center = subCenter
+			}
+			regions = append(regions, subRegions...)
+		}
+		return regions, center, nil
+	default:
+		return nil, s2.LatLng{}, errors.Errorf("unsupported WKB geometry type: %d", rawType)
+	}
+}
+
+func readWKBPoint(r *bytes.Reader, order binary.ByteOrder) (s2.LatLng, error) {
+	var lng, lat float64
+	if err := binary.Read(r, order, &lng); err != nil {
+		return s2.LatLng{}, errors.Wrap(err, "reading X")
+	}
+	if err := binary.Read(r, order, &lat); err != nil {
+		return s2.LatLng{}, errors.Wrap(err, "reading Y")
+	}
+	return s2.LatLngFromDegrees(lat, lng), nil
+}
+
+func readWKBPoints(r *bytes.Reader, order binary.ByteOrder) ([]s2.LatLng, error) {
+	var n uint32
+	if err := binary.Read(r, order, &n); err != nil {
+		return nil, errors.Wrap(err, "reading point count")
+	}
+	lls := make([]s2.LatLng, n)
+	for i := range lls {
+		ll, err := readWKBPoint(r, order)
+		if err != nil {
+			return nil, err
+		}
+		lls[i] = ll
+	}
+	return lls, nil
+}
+
+func readWKBRings(r *bytes.Reader, order binary.ByteOrder) ([][]s2.LatLng, error) {
+	var n uint32
+	if err := binary.Read(r, order, &n); err != nil {
+		return nil, errors.Wrap(err, "reading ring count")
+	}
+	rings := make([][]s2.LatLng, n)
+	for i := range rings {
+		lls, err := readWKBPoints(r, order)
+		if err != nil {
+			return nil, err
+		}
+		rings[i] = lls
+	}
+	return rings, nil
+}
+
+// WKB encoding, used when the source geometry wasn't already WKB (WKT and
+// shapefile ingestion) but still needs to round-trip into table.csv as hex
+// WKB.
+
+func putWKBHeader(buf *bytes.Buffer, typ wkbGeometryType) {
+	buf.WriteByte(byte(wkbLittleEndian))
+	binary.Write(buf, binary.LittleEndian, uint32(typ))
+}
+
+func putWKBPoints(buf *bytes.Buffer, lls []s2.LatLng) {
+	binary.Write(buf, binary.LittleEndian, uint32(len(lls)))
+	for _, ll := range lls {
+		binary.Write(buf, binary.LittleEndian, ll.Lng.Degrees())
+		binary.Write(buf, binary.LittleEndian, ll.Lat.Degrees())
+	}
+}
+
+func encodePointWKB(ll s2.LatLng) []byte {
+	var buf bytes.Buffer
+	putWKBHeader(&buf, wkbPoint)
+	binary.Write(&buf, binary.LittleEndian, ll.Lng.Degrees())
+	binary.Write(&buf, binary.LittleEndian, ll.Lat.Degrees())
+	return buf.Bytes()
+}
+
+func encodeLineStringWKB(lls []s2.LatLng) []byte {
+	var buf bytes.Buffer
+	putWKBHeader(&buf, wkbLineString)
+	putWKBPoints(&buf, lls)
+	return buf.Bytes()
+}
+
+func encodeMultiLineStringWKB(parts [][]s2.LatLng) []byte {
+	var buf bytes.Buffer
+	putWKBHeader(&buf, wkbMultiLineString)
+	binary.Write(&buf, binary.LittleEndian, uint32(len(parts)))
+	for _, lls := range parts {
+		buf.Write(encodeLineStringWKB(lls))
+	}
+	return buf.Bytes()
+}
+
+func encodeMultiPointWKB(lls []s2.LatLng) []byte {
+	var buf bytes.Buffer
+	putWKBHeader(&buf, wkbMultiPoint)
+	binary.Write(&buf, binary.LittleEndian, uint32(len(lls)))
+	for _, ll := range lls {
+		buf.Write(encodePointWKB(ll))
+	}
+	return buf.Bytes()
+}
+
+func encodePolygonWKB(rings [][]s2.LatLng) []byte {
+	var buf bytes.Buffer
+	putWKBHeader(&buf, wkbPolygon)
+	binary.Write(&buf, binary.LittleEndian, uint32(len(rings)))
+	for _, ring := range rings {
+		putWKBPoints(&buf, ring)
+	}
+	return buf.Bytes()
+}
@@ -3,11 +3,16 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/hex"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/codahale/hdrhistogram"
@@ -19,6 +24,7 @@ import (
 const (
 	histMinLatency = 1 * time.Microsecond
 	histMaxLatency = 100 * time.Second
+	histSigFigs    = 1
 
 	convertRows = 1000000
 
@@ -42,16 +48,24 @@ var cfg = &s2IndexConfig{
 
 type s2IndexConfig struct {
 	minLevel, maxLevel, maxCells int
+	rcOnce                       sync.Once
 	rc                           *s2.RegionCoverer
+
+	// preparedMu guards prepared, the cache of one *sql.Stmt per
+	// (operation, level, covering-size) tuple that ReadS2 lazily fills in.
+	preparedMu sync.Mutex
+	prepared   map[preparedKey]*sql.Stmt
 }
 
 func (c *s2IndexConfig) Covering(r s2.Region) []s2.CellID {
 	if c, ok := r.(s2.Cell); ok {
 		return []s2.CellID{c.ID()}
 	}
-	if c.rc == nil {
+	// rcOnce makes the lazy init safe when Covering is called
+	// concurrently by the convert/s2latencies worker pools.
+	c.rcOnce.Do(func() {
 		c.rc = &s2.RegionCoverer{MinLevel: c.minLevel, MaxLevel: c.maxLevel, MaxCells: c.maxCells}
-	}
+	})
 	covering := c.rc.Covering(r)
 	if c.maxCells == 1 && len(covering) != 1 {
 		// We covered a cube edge or corner and couldn't do 1 cell.
@@ -60,12 +74,29 @@ func (c *s2IndexConfig) Covering(r s2.Region) []s2.CellID {
 	return covering
 }
 
-func convert(in, table, index string, cfg *s2IndexConfig) error {
-	rr, err := makeRoadReader(in)
+// convertedRow is a road that's already had its covering computed and its
+// table.csv/index.csv lines rendered, ready for the writer goroutine.
+type convertedRow struct {
+	tableLine string
+	indexLine string
+}
+
+// convert reads roads from the given format, fans them out across
+// concurrency worker goroutines to compute cfg.Covering (the CPU-bound
+// step), and has a single writer goroutine drain the results to both
+// table.csv and index.csv; the two files are not written by separate
+// goroutines. Row ids stay monotonic because they're assigned by
+// the reader, sequentially, before any fan-out happens; since every line
+// written carries its id explicitly, the writers don't need to reorder
+// anything that arrives out of order. convertRows bounds the number of
+// converted (i.e. successfully indexed) rows, not rows merely read from
+// the input, so the read loop stops as soon as the writer has that many.
+func convert(in, table, index, format string, cfg *s2IndexConfig, concurrency int) error {
+	fr, err := makeFeatureReader(format, in)
 	if err != nil {
 		return err
 	}
-	defer rr.Close()
+	defer fr.Close()
 
 	tableW, err := os.Create(table)
 	if err != nil {
@@ -78,37 +109,101 @@ func convert(in, table, index string, cfg *s2IndexConfig) error {
 	}
 	defer indexW.Close()
 
+	workCh := make(chan road, concurrency*4)
+	resultCh := make(chan convertedRow, concurrency*4)
+
+	var workers sync.WaitGroup
+	workers.Add(concurrency)
+	for w := 0; w < concurrency; w++ {
+		go func() {
+			defer workers.Done()
+			for rd := range workCh {
+				var indexLine strings.Builder
+				var indexed bool
+				// Index every sub-geometry (e.g. each part of a
+				// MULTILINESTRING) under the same feature id instead of
+				// dropping it.
+				for _, region := range rd.geom.Regions() {
+					covering := cfg.Covering(region)
+					if covering == nil {
+						continue
+					}
+					indexed = true
+					for _, c := range covering {
+						fmt.Fprintf(&indexLine, `%d,%s`+"\n", rd.idx, c.ToToken())
+					}
+				}
+				if !indexed {
+					continue
+				}
+				name := strings.ReplaceAll(rd.name, `,`, ``)
+				tableLine := fmt.Sprintf(`%d,"%s","%s"`+"\n", rd.idx, name, hex.EncodeToString(rd.geom.WKB()))
+				resultCh <- convertedRow{tableLine: tableLine, indexLine: indexLine.String()}
+			}
+		}()
+	}
+	go func() {
+		workers.Wait()
+		close(resultCh)
+	}()
+
+	// stopReading is closed once the writer has accepted convertRows
+	// converted rows, so the read loop below can stop feeding workCh early
+	// instead of converting the rest of the input for nothing.
+	stopReading := make(chan struct{})
+	var stopOnce sync.Once
+
+	var writer sync.WaitGroup
+	writer.Add(1)
+	go func() {
+		defer writer.Done()
+		var written int
+		for r := range resultCh {
+			if written >= convertRows {
+				continue
+			}
+			io.WriteString(tableW, r.tableLine)
+			io.WriteString(indexW, r.indexLine)
+			written++
+			if written >= convertRows {
+				stopOnce.Do(func() { close(stopReading) })
+			}
+		}
+	}()
+
 	start := time.Now()
 	lastUpdate := start
-	for i := 0; i < convertRows; {
-		road, ok := rr.Next()
+readLoop:
+	for i := 0; ; i++ {
+		select {
+		case <-stopReading:
+			break readLoop
+		default:
+		}
+		rd, ok := fr.Next()
 		if !ok {
 			break
 		}
 		if now := time.Now(); now.Sub(lastUpdate) > updateInterval {
 			lastUpdate = now
-			fmt.Printf("finished %d queries in %s\n", i, now.Sub(start))
-		}
-
-		name := strings.ReplaceAll(road.name, `,`, ``)
-		polyline := s2.PolylineFromLatLngs(road.lls)
-		covering := cfg.Covering(polyline)
-		if covering == nil {
-			continue
+			fmt.Printf("read %d rows in %s\n", i, now.Sub(start))
 		}
-		i++
-		for _, c := range covering {
-			fmt.Fprintf(indexW, `%d,%s`+"\n", road.idx, c.ToToken())
+		select {
+		case workCh <- rd:
+		case <-stopReading:
+			break readLoop
 		}
-		fmt.Fprintf(tableW, `%d,"%s","%s"`+"\n", road.idx, name, road.geometry)
 	}
+	close(workCh)
+	writer.Wait()
+
 	if err := tableW.Sync(); err != nil {
 		return err
 	}
 	if err := indexW.Sync(); err != nil {
 		return err
 	}
-	if rr.skipped > 0 {
+	if rr, ok := fr.(*roadReader); ok && rr.skipped > 0 {
 		fmt.Printf("skipped %d\n", rr.skipped)
 	}
 	return nil
@@ -187,7 +282,58 @@ func ctrlcCtx() (ctx context.Context, cancel func()) {
 	return ctx, cancel
 }
 
-func latencies(conn, file string, cfg *s2IndexConfig) error {
+// newLatencyHistograms allocates one per-level nanosecond histogram for
+// each of n levels, shared by latencies and pebbleLatencies.
+func newLatencyHistograms(n int) []*hdrhistogram.Histogram {
+	hs := make([]*hdrhistogram.Histogram, n)
+	for i := range hs {
+		hs[i] = hdrhistogram.New(histMinLatency.Nanoseconds(), histMaxLatency.Nanoseconds(), histSigFigs)
+	}
+	return hs
+}
+
+// newCountHistograms allocates one per-level result-count histogram for
+// each of n levels, shared by latencies and pebbleLatencies.
+func newCountHistograms(n int) []*hdrhistogram.Histogram {
+	hs := make([]*hdrhistogram.Histogram, n)
+	for i := range hs {
+		hs[i] = hdrhistogram.New(0, 10000000, histSigFigs)
+	}
+	return hs
+}
+
+// printLatencyTable prints the level__meters__... latency/count table
+// shared by latencies and pebbleLatencies, skipping levels that saw no
+// queries.
+func printLatencyTable(nanosByLevel, countsByLevel []*hdrhistogram.Histogram) {
+	fmt.Println("level__meters_____numQ_pMin(ms)__p50(ms)__p95(ms)__p99(ms)_pMax(ms)__count50__count95__count99_countMax")
+	for level := range nanosByLevel {
+		nanosHist, countsHist := nanosByLevel[level], countsByLevel[level]
+		if nanosHist.TotalCount() == 0 {
+			continue
+		}
+		fmt.Printf("%5d %7d %8d %8.2f %8.2f %8.2f %8.2f %8.2f %8d %8d %8d %8d\n",
+			level,
+			int(metersFromLevel(level)),
+			nanosHist.TotalCount(),
+			time.Duration(nanosHist.Min()).Seconds()*1000,
+			time.Duration(nanosHist.ValueAtQuantile(50)).Seconds()*1000,
+			time.Duration(nanosHist.ValueAtQuantile(95)).Seconds()*1000,
+			time.Duration(nanosHist.ValueAtQuantile(99)).Seconds()*1000,
+			time.Duration(nanosHist.Max()).Seconds()*1000,
+			countsHist.ValueAtQuantile(50),
+			countsHist.ValueAtQuantile(95),
+			countsHist.ValueAtQuantile(99),
+			countsHist.Max(),
+		)
+	}
+}
+
+// latencies runs each operation type's queries against either CRDB/PostGIS
+// natively (cfg == nil) or through the roads_s2_idx S2 cell table on the
+// same connection (cfg != nil), with concurrency
+// worker goroutines issuing queries in flight against a shared *sql.DB.
+func latencies(conn, file string, cfg *s2IndexConfig, concurrency int) error {
 	ctx, cancel := ctrlcCtx()
 	defer cancel()
 
@@ -195,88 +341,146 @@ func latencies(conn, file string, cfg *s2IndexConfig) error {
 	if err != nil {
 		return errors.Wrapf(err, "connecting to: %s", conn)
 	}
+	db.SetMaxOpenConns(concurrency)
 
-	allQueryOps := []operationType{containsOperation, containingOperation, intersectsOperation}
+	allQueryOps := []operationType{containsOperation, containingOperation, intersectsOperation, knnOperation}
 	for i, queryOp := range allQueryOps {
 		if i != 0 {
 			fmt.Println()
 		}
-		fmt.Printf("starting query type %s shape %s\n", queryOp, queryShape)
-		const histSigFigs = 1
-		nanosByLevel := make([]*hdrhistogram.Histogram, queryMaxLevel+1)
-		for i := range nanosByLevel {
-			nanosByLevel[i] = hdrhistogram.New(
-				histMinLatency.Nanoseconds(), histMaxLatency.Nanoseconds(), histSigFigs)
-		}
-		countsByLevel := make([]*hdrhistogram.Histogram, queryMaxLevel+1)
-		for i := range countsByLevel {
-			countsByLevel[i] = hdrhistogram.New(0, 10000000, histSigFigs)
-		}
+		fmt.Printf("starting query type %s shape %s concurrency %d\n", queryOp, queryShape, concurrency)
+		// coldNanosByLevel separates out queries that paid the one-time
+		// cost of preparing a new statement (see s2IndexConfig.prepare)
+		// from the steady-state nanosByLevel below.
+		coldNanosByLevel := newLatencyHistograms(queryMaxLevel + 1)
+		nanosByLevel := newLatencyHistograms(queryMaxLevel + 1)
+		countsByLevel := newCountHistograms(queryMaxLevel + 1)
+		var histMu sync.Mutex
 
 		qr, err := makeQueryReader(file, querySelectivity, queryOp)
 		if err != nil {
 			return err
 		}
-
-		start := time.Now()
-		lastUpdate := start
+		var qrMu sync.Mutex
 		level := -1
-		for i := 0; i < latenciesMaxCount; level-- {
-			if err := ctx.Err(); err != nil {
-				break
-			}
+		// nextQuery hands out (query, level) pairs one at a time; the
+		// level sequencing matches the single-threaded version exactly,
+		// since it's still assigned by one goroutine holding qrMu.
+		nextQuery := func() (query, int, bool) {
+			qrMu.Lock()
+			defer qrMu.Unlock()
 			q, ok := qr.Next()
 			if !ok {
-				break
-			}
-			if now := time.Now(); now.Sub(lastUpdate) > updateInterval {
-				lastUpdate = now
-				fmt.Printf("finished %d queries in %s\n", i, now.Sub(start))
+				return query{}, 0, false
 			}
-
+			level--
 			if level < queryMinLevel {
 				level = queryMaxLevel
 			}
-			qStart := time.Now()
-			var count int64
-			var err error
-			if cfg != nil {
-				count, err = q.ReadS2(db, cfg, level)
-			} else {
-				count, err = q.ReadPostGIS(db, level)
-			}
-			qDuration := time.Since(qStart)
-			if err == errQuerySkipped {
-				continue
-			} else if err != nil {
-				return err
+			return q, level, true
+		}
+
+		start := time.Now()
+		var completed int64
+		workerCtx, workerCancel := context.WithCancel(ctx)
+		var firstErr error
+		var errOnce sync.Once
+
+		var workers sync.WaitGroup
+		workers.Add(concurrency)
+		for w := 0; w < concurrency; w++ {
+			go func() {
+				defer workers.Done()
+				for workerCtx.Err() == nil && atomic.LoadInt64(&completed) < latenciesMaxCount {
+					q, lvl, ok := nextQuery()
+					if !ok {
+						return
+					}
+					qStart := time.Now()
+					var count int64
+					var cold bool
+					var err error
+					if cfg != nil {
+						count, cold, err = q.ReadS2(db, cfg, lvl)
+					} else {
+						count, err = q.ReadPostGIS(db, lvl)
+					}
+					qDuration := time.Since(qStart)
+					if err == errQuerySkipped {
+						continue
+					} else if err != nil {
+						errOnce.Do(func() {
+							firstErr = err
+							workerCancel()
+						})
+						return
+					}
+					histMu.Lock()
+					if cold {
+						coldNanosByLevel[lvl].RecordValue(qDuration.Nanoseconds())
+					} else {
+						nanosByLevel[lvl].RecordValue(qDuration.Nanoseconds())
+					}
+					countsByLevel[lvl].RecordValue(count)
+					histMu.Unlock()
+					atomic.AddInt64(&completed, 1)
+				}
+			}()
+		}
+
+		progressDone := make(chan struct{})
+		go func() {
+			ticker := time.NewTicker(updateInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					fmt.Printf("finished %d queries in %s\n", atomic.LoadInt64(&completed), time.Since(start))
+				case <-progressDone:
+					return
+				}
 			}
-			i++
-			nanosByLevel[level].RecordValue(qDuration.Nanoseconds())
-			countsByLevel[level].RecordValue(count)
+		}()
+		workers.Wait()
+		workerCancel()
+		close(progressDone)
+
+		if firstErr != nil {
+			return firstErr
 		}
 
-		fmt.Printf("finished query type %s shape %s\n", queryOp, queryShape)
-		fmt.Println("level__meters_____numQ_pMin(ms)__p50(ms)__p95(ms)__p99(ms)_pMax(ms)__count50__count95__count99_countMax")
-		for level := range nanosByLevel {
-			nanosHist, countsHist := nanosByLevel[level], countsByLevel[level]
-			if nanosHist.TotalCount() == 0 {
-				continue
+		elapsed := time.Since(start)
+		qps := float64(completed) / elapsed.Seconds()
+		fmt.Printf("finished query type %s shape %s: %d queries in %s (%.1f qps)\n",
+			queryOp, queryShape, completed, elapsed, qps)
+		printLatencyTable(nanosByLevel, countsByLevel)
+		if cfg != nil {
+			anyCold := false
+			for _, h := range coldNanosByLevel {
+				if h.TotalCount() > 0 {
+					anyCold = true
+					break
+				}
+			}
+			if anyCold {
+				fmt.Println("cold (first query per prepared-statement bucket):")
+				fmt.Println("level__meters_____numQ_pMin(ms)__p50(ms)__p95(ms)__p99(ms)_pMax(ms)")
+				for level, coldHist := range coldNanosByLevel {
+					if coldHist.TotalCount() == 0 {
+						continue
+					}
+					fmt.Printf("%5d %7d %8d %8.2f %8.2f %8.2f %8.2f %8.2f\n",
+						level,
+						int(metersFromLevel(level)),
+						coldHist.TotalCount(),
+						time.Duration(coldHist.Min()).Seconds()*1000,
+						time.Duration(coldHist.ValueAtQuantile(50)).Seconds()*1000,
+						time.Duration(coldHist.ValueAtQuantile(95)).Seconds()*1000,
+						time.Duration(coldHist.ValueAtQuantile(99)).Seconds()*1000,
+						time.Duration(coldHist.Max()).Seconds()*1000,
+					)
+				}
 			}
-			fmt.Printf("%5d %7d %8d %8.2f %8.2f %8.2f %8.2f %8.2f %8d %8d %8d %8d\n",
-				level,
-				int(metersFromLevel(level)),
-				nanosHist.TotalCount(),
-				time.Duration(nanosHist.Min()).Seconds()*1000,
-				time.Duration(nanosHist.ValueAtQuantile(50)).Seconds()*1000,
-				time.Duration(nanosHist.ValueAtQuantile(95)).Seconds()*1000,
-				time.Duration(nanosHist.ValueAtQuantile(99)).Seconds()*1000,
-				time.Duration(nanosHist.Max()).Seconds()*1000,
-				countsHist.ValueAtQuantile(50),
-				countsHist.ValueAtQuantile(95),
-				countsHist.ValueAtQuantile(99),
-				countsHist.Max(),
-			)
 		}
 		if err := ctx.Err(); err != nil {
 			return nil
@@ -293,11 +497,15 @@ func main() {
 	}
 	switch args[0] {
 	case `convert`:
-		subArgs := args[1:]
+		fs := flag.NewFlagSet(`convert`, flag.ExitOnError)
+		format := fs.String(`format`, `wkt`, `ingestion format: wkt, shp, or wkb`)
+		concurrency := fs.Int(`concurrency`, 1, `number of worker goroutines computing coverings`)
+		fs.Parse(args[1:])
+		subArgs := fs.Args()
 		if len(subArgs) != 3 {
-			log.Fatalf("usage: %s convert <in.csv.bz2> <table.csv> <index.csv>", os.Args[0])
+			log.Fatalf("usage: %s convert [-format wkt|shp|wkb] [-concurrency N] <in> <table.csv> <index.csv>", os.Args[0])
 		}
-		if err := convert(subArgs[0], subArgs[1], subArgs[2], cfg); err != nil {
+		if err := convert(subArgs[0], subArgs[1], subArgs[2], *format, cfg, *concurrency); err != nil {
 			log.Fatal(err)
 		}
 	case `crdbload`:
@@ -317,15 +525,34 @@ func main() {
 			log.Fatal(err)
 		}
 	case `s2latencies`, `pglatencies`:
-		subArgs := args[1:]
+		fs := flag.NewFlagSet(args[0], flag.ExitOnError)
+		concurrency := fs.Int(`concurrency`, 1, `number of queries to run in flight at once`)
+		fs.Parse(args[1:])
+		subArgs := fs.Args()
 		if len(subArgs) != 2 {
-			log.Fatalf("usage: %s %s <conn> <data.csv.bz2>", os.Args[0], args[0])
+			log.Fatalf("usage: %s %s [-concurrency N] <conn> <data.csv.bz2>", os.Args[0], args[0])
 		}
 		var s2Cfg *s2IndexConfig
 		if args[0] == `s2latencies` {
 			s2Cfg = cfg
 		}
-		if err := latencies(subArgs[0], subArgs[1], s2Cfg); err != nil {
+		if err := latencies(subArgs[0], subArgs[1], s2Cfg, *concurrency); err != nil {
+			log.Fatal(err)
+		}
+	case `pebbleload`:
+		subArgs := args[1:]
+		if len(subArgs) != 2 {
+			log.Fatalf("usage: %s pebbleload <index.csv> <index.sst>", os.Args[0])
+		}
+		if err := pebbleLoad(subArgs[0], subArgs[1]); err != nil {
+			log.Fatal(err)
+		}
+	case `pebblelatencies`:
+		subArgs := args[1:]
+		if len(subArgs) != 2 {
+			log.Fatalf("usage: %s pebblelatencies <index.sst> <data.csv.bz2>", os.Args[0])
+		}
+		if err := pebbleLatencies(subArgs[0], subArgs[1], cfg); err != nil {
 			log.Fatal(err)
 		}
 	default:
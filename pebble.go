@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/cockroachdb/pebble/sstable"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/pkg/errors"
+)
+
+// sstEntry is one row of index.csv, ready to become an SSTable entry keyed
+// by cell token.
+type sstEntry struct {
+	token string
+	id    uint64
+}
+
+// pebbleLoad reads the index.csv produced by convert and writes a sorted
+// SSTable whose keys are cell tokens and whose values are the varint-encoded
+// ids indexed under that token, concatenated back to back; many roads
+// commonly share a token (e.g. at maxCells==1 every road, or every part of a
+// multi-part road, is a single cell), and
+// sstable.Writer.Set requires strictly increasing keys, so every id for a
+// token has to be packed into that token's single value rather than given
+// its own entry. ReadSST decodes the concatenated varints back out.
+func pebbleLoad(index, sstPath string) error {
+	f, err := os.Open(index)
+	if err != nil {
+		return errors.Wrapf(err, "opening %s", index)
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = 2
+
+	var entries []sstEntry
+	for {
+		parts, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.Wrapf(err, "reading %s", index)
+		}
+		id, err := strconv.ParseUint(parts[0], 10, 64)
+		if err != nil {
+			return errors.Wrapf(err, "parsing id: %s", parts[0])
+		}
+		entries = append(entries, sstEntry{token: parts[1], id: id})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].token < entries[j].token })
+
+	sstF, err := vfs.Default.Create(sstPath)
+	if err != nil {
+		return errors.Wrapf(err, "creating %s", sstPath)
+	}
+	w := sstable.NewWriter(sstF, sstable.WriterOptions{})
+	var buf [binary.MaxVarintLen64]byte
+	var value []byte
+	for i := 0; i < len(entries); {
+		j := i
+		value = value[:0]
+		for j < len(entries) && entries[j].token == entries[i].token {
+			n := binary.PutUvarint(buf[:], entries[j].id)
+			value = append(value, buf[:n]...)
+			j++
+		}
+		if err := w.Set([]byte(entries[i].token), value); err != nil {
+			return errors.Wrapf(err, "writing %s", sstPath)
+		}
+		i = j
+	}
+	if err := w.Close(); err != nil {
+		return errors.Wrapf(err, "closing %s", sstPath)
+	}
+	fmt.Printf("wrote %d entries to %s\n", len(entries), sstPath)
+	return nil
+}
+
+// pebbleLatencies mirrors latencies, but benchmarks ReadSST against a
+// pebbleload-produced SSTable instead of querying CRDB/PostGIS over the
+// network.
+func pebbleLatencies(sstPath, file string, cfg *s2IndexConfig) error {
+	ctx, cancel := ctrlcCtx()
+	defer cancel()
+
+	sstF, err := vfs.Default.Open(sstPath)
+	if err != nil {
+		return errors.Wrapf(err, "opening %s", sstPath)
+	}
+	r, err := sstable.NewReader(sstF, sstable.ReaderOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "reading %s", sstPath)
+	}
+	defer r.Close()
+
+	allQueryOps := []operationType{containsOperation, containingOperation, intersectsOperation}
+	for i, queryOp := range allQueryOps {
+		if i != 0 {
+			fmt.Println()
+		}
+		fmt.Printf("starting query type %s shape %s\n", queryOp, queryShape)
+		nanosByLevel := newLatencyHistograms(queryMaxLevel + 1)
+		countsByLevel := newCountHistograms(queryMaxLevel + 1)
+
+		qr, err := makeQueryReader(file, querySelectivity, queryOp)
+		if err != nil {
+			return err
+		}
+
+		start := time.Now()
+		lastUpdate := start
+		level := -1
+		for i := 0; i < latenciesMaxCount; level-- {
+			if err := ctx.Err(); err != nil {
+				break
+			}
+			q, ok := qr.Next()
+			if !ok {
+				break
+			}
+			if now := time.Now(); now.Sub(lastUpdate) > updateInterval {
+				lastUpdate = now
+				fmt.Printf("finished %d queries in %s\n", i, now.Sub(start))
+			}
+
+			if level < queryMinLevel {
+				level = queryMaxLevel
+			}
+			qStart := time.Now()
+			count, _, err := q.ReadSST(r, level)
+			qDuration := time.Since(qStart)
+			if err == errQuerySkipped {
+				continue
+			} else if err != nil {
+				return err
+			}
+			i++
+			nanosByLevel[level].RecordValue(qDuration.Nanoseconds())
+			countsByLevel[level].RecordValue(int64(count))
+		}
+
+		fmt.Printf("finished query type %s shape %s\n", queryOp, queryShape)
+		printLatencyTable(nanosByLevel, countsByLevel)
+		if err := ctx.Err(); err != nil {
+			return nil
+		}
+	}
+
+	return nil
+}
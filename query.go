@@ -2,15 +2,19 @@ package main
 
 import (
 	"bytes"
+	"container/heap"
 	"database/sql"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"math"
+	"math/rand"
+
 	"github.com/cockroachdb/pebble"
 	"github.com/cockroachdb/pebble/sstable"
 	"github.com/golang/geo/s1"
 	"github.com/golang/geo/s2"
 	"github.com/pkg/errors"
-	"math/rand"
 )
 
 type shapeType string
@@ -32,8 +36,32 @@ const (
 	// intersectsOperation retrieves indexed bounding boxes that intersect
 	// this shape's bounding box. This is the union of contains and containing.
 	intersectsOperation operationType = "intersects"
+	// knnOperation retrieves the k nearest indexed geometries to the query
+	// point, by expanding search rings until the worst match found is
+	// nearer than the next ring's radius (see readKNN).
+	knnOperation operationType = "knn"
 )
 
+const (
+	// knnK is the default number of neighbors a knnOperation query asks for.
+	knnK = 10
+	// knnMaxRadiusMeters caps how far readKNN will expand its search rings.
+	knnMaxRadiusMeters = 5000
+	// knnMaxCells bounds how many cells readKNN's RegionCoverer may return
+	// for one search ring. Unlike the point index's cfg (MaxCells: 1, which
+	// returns nil whenever a cap can't be covered by exactly one cell),
+	// readKNN wants an actual covering of every ring, however many cells
+	// that takes.
+	knnMaxCells = 8
+)
+
+// knnCoverer computes the cell covering for readKNN's expanding search
+// rings. It's separate from cfg, the point index's RegionCoverer, because
+// the two have incompatible requirements: cfg demands exactly one cell per
+// region and gives up otherwise, while readKNN needs a real covering of
+// every ring it searches.
+var knnCoverer = &s2.RegionCoverer{MinLevel: queryMinLevel, MaxLevel: queryMaxLevel, MaxCells: knnMaxCells}
+
 func arcFromLevel(level int) float64 {
 	return s2.AvgAngleSpanMetric.Value(level)
 }
@@ -42,6 +70,10 @@ func metersFromLevel(level int) float64 {
 	return float64(earthRadiusMeters) * arcFromLevel(level)
 }
 
+func angleFromMeters(meters float64) s1.Angle {
+	return s1.Angle(meters / earthRadiusMeters)
+}
+
 type queryReader struct {
 	rr          *roadReader
 	rng         *rand.Rand
@@ -75,10 +107,14 @@ func (qr *queryReader) Next() (query, bool) {
 			continue
 		}
 		q := query{
-			center: road.lls[0],
+			center: road.geom.Center(),
 			shape:  queryShape,
 			op:     qr.op,
 		}
+		if qr.op == knnOperation {
+			q.k = knnK
+			q.maxRadiusMeters = knnMaxRadiusMeters
+		}
 		return q, ok
 	}
 }
@@ -88,6 +124,10 @@ type query struct {
 
 	shape shapeType
 	op    operationType
+
+	// k and maxRadiusMeters only apply to knnOperation.
+	k               int
+	maxRadiusMeters float64
 }
 
 // ancestorCells returns the set of cells containing these cells, not including
@@ -130,7 +170,6 @@ func containingQ(w *bytes.Buffer, cells []s2.CellID) {
 }
 
 var errQuerySkipped = errors.New(`skipped`)
-var queryCoveringCounts [20]int64
 
 func (q query) GetCovering(level int) []s2.CellID {
 	var r s2.Region
@@ -150,10 +189,6 @@ func (q query) GetCovering(level int) []s2.CellID {
 		panic(`unhandled shape: ` + q.shape)
 	}
 	covering := cfg.Covering(r)
-	if len(covering) > len(queryCoveringCounts) {
-		panic("")
-	}
-	queryCoveringCounts[len(covering)]++
 	return covering
 }
 
@@ -163,83 +198,422 @@ func (q query) ReadSST(r *sstable.Reader, level int) (int, int, error) {
 		// Couldn't do this covering.
 		return 0, 0, errQuerySkipped
 	}
-	if q.op != containsOperation {
-		panic("unsupported operation")
-	}
+
 	iter := r.NewIter(nil, nil)
 	idMap := make(map[uint64]struct{})
 	var rowCount int
-	for _, c := range covering {
-		first := []byte(c.RangeMin().ToToken())
-		last := []byte(c.RangeMax().ToToken())
-		var k *pebble.InternalKey
-		var v []byte
-		for k, v = iter.SeekGE(first); k != nil && bytes.Compare(k.UserKey, last) <= 0; k, v = iter.Next() {
+	// record decodes the ids packed into one token's value (see pebbleLoad)
+	// and accounts for each of them individually.
+	record := func(v []byte) {
+		for len(v) > 0 {
 			id, n := binary.Uvarint(v)
 			if n <= 0 {
 				panic("unable to parse varint")
 			}
-			if _, ok := idMap[id]; !ok {
-				idMap[id] = struct{}{}
-			}
-			// idMap[id] = struct{}{}
+			idMap[id] = struct{}{}
 			rowCount++
+			v = v[n:]
+		}
+	}
+	// scanRange walks every entry whose key falls in [first, last], the SST
+	// equivalent of containsQ's `s2 BETWEEN ... AND ...`.
+	scanRange := func(first, last []byte) {
+		var k *pebble.InternalKey
+		var v []byte
+		for k, v = iter.SeekGE(first); k != nil && bytes.Compare(k.UserKey, last) <= 0; k, v = iter.Next() {
+			record(v)
+		}
+	}
+	// scanExact walks every entry with key == token, the SST equivalent of
+	// containingQ's `s2 IN (...)`.
+	scanExact := func(token []byte) {
+		var k *pebble.InternalKey
+		var v []byte
+		for k, v = iter.SeekGE(token); k != nil && bytes.Equal(k.UserKey, token); k, v = iter.Next() {
+			record(v)
 		}
 	}
 
+	switch q.op {
+	case containsOperation:
+		for _, c := range covering {
+			scanRange([]byte(c.RangeMin().ToToken()), []byte(c.RangeMax().ToToken()))
+		}
+	case containingOperation:
+		for _, c := range append(ancestorCells(covering...), covering...) {
+			scanExact([]byte(c.ToToken()))
+		}
+	case intersectsOperation:
+		for _, c := range covering {
+			scanRange([]byte(c.RangeMin().ToToken()), []byte(c.RangeMax().ToToken()))
+		}
+		for _, c := range ancestorCells(covering...) {
+			scanExact([]byte(c.ToToken()))
+		}
+	default:
+		panic(`unhandled operation: ` + q.op)
+	}
+
 	if err := iter.Close(); err != nil {
 		return 0, 0, err
 	}
 	return len(idMap), rowCount, nil
 }
 
-func (q query) ReadS2(db *sql.DB, cfg *s2IndexConfig, level int, printQuery bool) (int64, error) {
-	covering := q.GetCovering(level)
+// preparedKey identifies one cached *sql.Stmt. numCells is the number of
+// BETWEEN-range placeholders (containsOperation, and the range half of
+// intersectsOperation); ancestorBucket is the number of IN-list
+// placeholders for containingOperation/intersectsOperation, rounded up to
+// the next power of two so that queries with slightly different ancestor
+// counts (which vary with cell depth) still share a handful of statements
+// instead of one per exact count.
+type preparedKey struct {
+	op             operationType
+	level          int
+	numCells       int
+	ancestorBucket int
+}
+
+func nextPowerOfTwo(n int) int {
+	p := 1
+	for p < n {
+		p *= 2
+	}
+	return p
+}
+
+// prepare returns the cached *sql.Stmt for key, preparing and caching it
+// (via sqlText) on the first call. The second return value is true the
+// first time a given key is prepared, so callers can separate "cold"
+// (includes prepare cost) from "warm" latencies.
+func (c *s2IndexConfig) prepare(db *sql.DB, key preparedKey, sqlText func() string) (*sql.Stmt, bool, error) {
+	c.preparedMu.Lock()
+	defer c.preparedMu.Unlock()
+	if c.prepared == nil {
+		c.prepared = make(map[preparedKey]*sql.Stmt)
+	}
+	if stmt, ok := c.prepared[key]; ok {
+		return stmt, false, nil
+	}
+	stmt, err := db.Prepare(sqlText())
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "preparing statement for %+v", key)
+	}
+	c.prepared[key] = stmt
+	return stmt, true, nil
+}
+
+func countSelectSQL(maxCells int) string {
+	if maxCells == 1 {
+		// Take advantage of the fact that there's only one cell indexed for
+		// each shape.
+		return `SELECT count(id) FROM roads_s2_idx WHERE `
+	}
+	return `SELECT count(distinct(id)) FROM roads_s2_idx WHERE `
+}
+
+func containsStmtSQL(maxCells, numCells int) string {
+	var buf bytes.Buffer
+	buf.WriteString(countSelectSQL(maxCells))
+	for i := 0; i < numCells; i++ {
+		if i != 0 {
+			buf.WriteString(` OR `)
+		}
+		fmt.Fprintf(&buf, `s2 BETWEEN $%d AND $%d`, 2*i+1, 2*i+2)
+	}
+	return buf.String()
+}
+
+func containingStmtSQL(maxCells, ancestorBucket int) string {
+	var buf bytes.Buffer
+	buf.WriteString(countSelectSQL(maxCells))
+	buf.WriteString(`s2 IN (`)
+	for i := 0; i < ancestorBucket; i++ {
+		if i != 0 {
+			buf.WriteString(`, `)
+		}
+		fmt.Fprintf(&buf, `$%d`, i+1)
+	}
+	buf.WriteString(`)`)
+	return buf.String()
+}
+
+func intersectsStmtSQL(maxCells, numCells, ancestorBucket int) string {
+	var buf bytes.Buffer
+	buf.WriteString(countSelectSQL(maxCells))
+	for i := 0; i < numCells; i++ {
+		if i != 0 {
+			buf.WriteString(` OR `)
+		}
+		fmt.Fprintf(&buf, `s2 BETWEEN $%d AND $%d`, 2*i+1, 2*i+2)
+	}
+	buf.WriteString(` OR s2 IN (`)
+	base := 2 * numCells
+	for i := 0; i < ancestorBucket; i++ {
+		if i != 0 {
+			buf.WriteString(`, `)
+		}
+		fmt.Fprintf(&buf, `$%d`, base+i+1)
+	}
+	buf.WriteString(`)`)
+	return buf.String()
+}
 
+// tokenArgs converts cells to query args, padding out to n entries by
+// repeating the last token (harmless in an IN-list) so a bucketed
+// statement can be reused across calls with slightly different ancestor
+// counts.
+func tokenArgs(cells []s2.CellID, n int) []interface{} {
+	args := make([]interface{}, n)
+	for i := range args {
+		switch {
+		case i < len(cells):
+			args[i] = cells[i].ToToken()
+		case len(cells) > 0:
+			args[i] = cells[len(cells)-1].ToToken()
+		default:
+			// No ancestors at all (e.g. a level-0 cell); pad with a token
+			// that can't match anything real.
+			args[i] = ``
+		}
+	}
+	return args
+}
+
+func (q query) ReadS2(db *sql.DB, cfg *s2IndexConfig, level int) (int64, bool, error) {
+	if q.op == knnOperation {
+		count, err := q.readKNN(db)
+		return count, false, err
+	}
+
+	covering := q.GetCovering(level)
 	if covering == nil {
 		// Couldn't do this covering.
-		return 0, errQuerySkipped
+		return 0, false, errQuerySkipped
 	}
 
-	var queryBuf bytes.Buffer
-	queryBuf.WriteString(`SELECT `)
-	if cfg.maxCells == 1 {
-		// Take advantage of the fact that there's only one cell indexed for each
-		// shape.
-		queryBuf.WriteString(`count(id)`)
-	} else {
-		queryBuf.WriteString(`count(distinct(id))`)
-	}
-	queryBuf.WriteString(` FROM roads_s2_idx WHERE `)
+	var stmt *sql.Stmt
+	var cold bool
+	var err error
+	var args []interface{}
+
 	switch q.op {
 	case containsOperation:
-		containsQ(&queryBuf, covering)
+		numCells := len(covering)
+		key := preparedKey{op: q.op, level: level, numCells: numCells}
+		stmt, cold, err = cfg.prepare(db, key, func() string { return containsStmtSQL(cfg.maxCells, numCells) })
+		args = make([]interface{}, 0, 2*numCells)
+		for _, c := range covering {
+			args = append(args, c.RangeMin().ToToken(), c.RangeMax().ToToken())
+		}
 	case containingOperation:
-		containingQ(&queryBuf, append(ancestorCells(covering...), covering...))
-		// containingQ(&queryBuf, append(ancestorCells(covering...)))
-		// containingQ(&queryBuf, covering)
+		tokens := append(ancestorCells(covering...), covering...)
+		bucket := nextPowerOfTwo(len(tokens))
+		key := preparedKey{op: q.op, level: level, ancestorBucket: bucket}
+		stmt, cold, err = cfg.prepare(db, key, func() string { return containingStmtSQL(cfg.maxCells, bucket) })
+		args = tokenArgs(tokens, bucket)
 	case intersectsOperation:
-		containsQ(&queryBuf, covering)
-		queryBuf.WriteString(` OR `)
 		// Don't append the covering cells themselves like we do for
-		// containingOperation because the LIKE already handles it.
-		containingQ(&queryBuf, ancestorCells(covering...))
+		// containingOperation, because the BETWEEN ranges already cover them.
+		ancestors := ancestorCells(covering...)
+		numCells := len(covering)
+		bucket := nextPowerOfTwo(len(ancestors))
+		key := preparedKey{op: q.op, level: level, numCells: numCells, ancestorBucket: bucket}
+		stmt, cold, err = cfg.prepare(db, key, func() string {
+			return intersectsStmtSQL(cfg.maxCells, numCells, bucket)
+		})
+		args = make([]interface{}, 0, 2*numCells+bucket)
+		for _, c := range covering {
+			args = append(args, c.RangeMin().ToToken(), c.RangeMax().ToToken())
+		}
+		args = append(args, tokenArgs(ancestors, bucket)...)
 	default:
 		panic(`unhandled operation: ` + q.op)
 	}
+	if err != nil {
+		return 0, false, err
+	}
 
-	// TODO(dan): Prepare all these. A little tricky since containing and
-	// intersects each need a one version for each cell level.
 	var count int64
-	if printQuery && false {
-		fmt.Printf("%s\n", queryBuf.String())
+	err = stmt.QueryRow(args...).Scan(&count)
+	err = errors.Wrapf(err, `executing %s query`, q.op)
+	return count, cold, err
+}
+
+// knnCandidate is one candidate neighbor tracked by readKNN's bounded
+// max-heap; the heap keeps the farthest of the current top-k at the root,
+// so it's cheap to evict once the heap is full.
+type knnCandidate struct {
+	id   int64
+	dist s1.Angle
+}
+
+type knnHeap []knnCandidate
+
+func (h knnHeap) Len() int            { return len(h) }
+func (h knnHeap) Less(i, j int) bool  { return h[i].dist > h[j].dist }
+func (h knnHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *knnHeap) Push(x interface{}) { *h = append(*h, x.(knnCandidate)) }
+func (h *knnHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	v := old[n-1]
+	*h = old[:n-1]
+	return v
+}
+
+// readKNN implements k-nearest-neighbor search by expanding a search cap
+// centered on q.center, doubling its radius each round, until the heap
+// holds k candidates and the current worst match is nearer than the next
+// round's radius, or the radius reaches q.maxRadiusMeters. The band between
+// the current radius and the next one is not searched before stopping, so a
+// road in that band that is closer than the worst match can be missed.
+func (q query) readKNN(db *sql.DB) (int64, error) {
+	maxRadius := angleFromMeters(q.maxRadiusMeters)
+	radius := s1.Angle(arcFromLevel(queryMaxLevel))
+	if radius > maxRadius {
+		radius = maxRadius
 	}
-	err := db.QueryRow(queryBuf.String()).Scan(&count)
-	err = errors.Wrapf(err, `executing: %s`, queryBuf.String())
-	return count, err
+
+	h := &knnHeap{}
+	seen := make(map[int64]struct{})
+
+	for {
+		capRegion := s2.CapFromCenterAngle(s2.PointFromLatLng(q.center), radius)
+		covering := knnCoverer.Covering(capRegion)
+		if len(covering) == 0 {
+			return 0, errQuerySkipped
+		}
+		if err := q.scanKNNCandidates(db, covering, seen, h); err != nil {
+			return 0, err
+		}
+
+		atMaxRadius := radius >= maxRadius
+		nextRadius := radius * 2
+		if nextRadius > maxRadius {
+			nextRadius = maxRadius
+		}
+		if h.Len() >= q.k && (*h)[0].dist < nextRadius {
+			break
+		}
+		if atMaxRadius {
+			// Hit the radius cap; stop with whatever we've found so far.
+			break
+		}
+		radius = nextRadius
+	}
+
+	return int64(h.Len()), nil
+}
+
+// scanKNNCandidates fetches every road indexed under covering, decodes its
+// WKB geometry, and pushes it onto h if it's among the k closest seen so
+// far.
+func (q query) scanKNNCandidates(
+	db *sql.DB, covering []s2.CellID, seen map[int64]struct{}, h *knnHeap,
+) error {
+	var queryBuf bytes.Buffer
+	queryBuf.WriteString(
+		`SELECT DISTINCT roads.id, roads.geometry FROM roads_s2_idx ` +
+			`JOIN roads ON roads.id = roads_s2_idx.id WHERE `)
+	containsQ(&queryBuf, covering)
+
+	rows, err := db.Query(queryBuf.String())
+	if err != nil {
+		return errors.Wrapf(err, `executing: %s`, queryBuf.String())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var hexWKB string
+		if err := rows.Scan(&id, &hexWKB); err != nil {
+			return err
+		}
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+
+		b, err := hex.DecodeString(hexWKB)
+		if err != nil {
+			return errors.Wrapf(err, "invalid hex WKB for id %d", id)
+		}
+		geom, err := parseWKB(b)
+		if err != nil {
+			return errors.Wrapf(err, "invalid WKB for id %d", id)
+		}
+		dist := distanceToRegions(q.center, geom.Regions())
+
+		if h.Len() < q.k {
+			heap.Push(h, knnCandidate{id: id, dist: dist})
+		} else if dist < (*h)[0].dist {
+			heap.Pop(h)
+			heap.Push(h, knnCandidate{id: id, dist: dist})
+		}
+	}
+	return rows.Err()
+}
+
+// distanceToRegions returns the true spherical distance from center to the
+// nearest of the given regions.
+func distanceToRegions(center s2.LatLng, regions []s2.Region) s1.Angle {
+	pt := s2.PointFromLatLng(center)
+	best := s1.InfAngle()
+	for _, r := range regions {
+		var d s1.Angle
+		switch g := r.(type) {
+		case *s2.Polyline:
+			proj, _ := g.Project(pt)
+			d = angleBetweenPoints(pt, proj)
+		case *s2.Polygon:
+			if g.ContainsPoint(pt) {
+				d = 0
+			} else {
+				// s2.Polygon has no Project method; measure against each
+				// loop's boundary as a closed polyline instead.
+				d = s1.InfAngle()
+				for i := 0; i < g.NumLoops(); i++ {
+					loop := g.Loop(i)
+					pts := make([]s2.Point, loop.NumVertices()+1)
+					for j := 0; j < loop.NumVertices(); j++ {
+						pts[j] = loop.Vertex(j)
+					}
+					pts[len(pts)-1] = pts[0]
+					pl := s2.Polyline(pts)
+					proj, _ := pl.Project(pt)
+					if ld := angleBetweenPoints(pt, proj); ld < d {
+						d = ld
+					}
+				}
+			}
+		case s2.Point:
+			d = angleBetweenPoints(pt, g)
+		default:
+			continue
+		}
+		if d < best {
+			best = d
+		}
+	}
+	return best
+}
+
+func angleBetweenPoints(a, b s2.Point) s1.Angle {
+	dot := a.Dot(b.Vector)
+	if dot > 1 {
+		dot = 1
+	} else if dot < -1 {
+		dot = -1
+	}
+	return s1.Angle(math.Acos(dot))
 }
 
 func (q query) ReadPostGIS(db *sql.DB, level int) (int64, error) {
+	if q.op == knnOperation {
+		return q.readKNNPostGIS(db)
+	}
+
 	var geom string
 	switch q.shape {
 	case cellShape, rectShape:
@@ -277,3 +651,28 @@ func (q query) ReadPostGIS(db *sql.DB, level int) (int64, error) {
 	err = errors.Wrapf(err, `executing: %s`, query)
 	return count, err
 }
+
+// readKNNPostGIS is the PostGIS reference implementation for knnOperation,
+// using the <-> KNN distance operator so it can be compared against readKNN
+// in the same histogram framework.
+func (q query) readKNNPostGIS(db *sql.DB) (int64, error) {
+	query := fmt.Sprintf(
+		`SELECT id FROM roads ORDER BY geometry <-> ST_SetSRID(ST_MakePoint(%v, %v), 4326) LIMIT %d`,
+		q.center.Lng.Degrees(), q.center.Lat.Degrees(), q.k,
+	)
+	rows, err := db.Query(query)
+	if err != nil {
+		return 0, errors.Wrapf(err, `executing: %s`, query)
+	}
+	defer rows.Close()
+
+	var count int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return 0, err
+		}
+		count++
+	}
+	return count, rows.Err()
+}
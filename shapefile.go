@@ -0,0 +1,130 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/golang/geo/s2"
+	shp "github.com/jonas-p/go-shp"
+	"github.com/pkg/errors"
+)
+
+// shapefileReader ingests features from an ESRI shapefile (a .shp paired
+// with a .dbf), implementing the same Next-until-EOF protocol as roadReader
+// so convert can treat both sources identically.
+type shapefileReader struct {
+	i       int
+	r       *shp.Reader
+	nameIdx int
+}
+
+func makeShapefileReader(path string) (*shapefileReader, error) {
+	r, err := shp.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening %s", path)
+	}
+	nameIdx := -1
+	for i, f := range r.Fields() {
+		if strings.EqualFold(f.String(), `name`) {
+			nameIdx = i
+			break
+		}
+	}
+	return &shapefileReader{r: r, nameIdx: nameIdx}, nil
+}
+
+func (sr *shapefileReader) Close() {
+	sr.r.Close()
+}
+
+func (sr *shapefileReader) Next() (road, bool) {
+	if !sr.r.Next() {
+		return road{}, false
+	}
+	n, shape := sr.r.Shape()
+	geom, err := geometryFromShape(shape)
+	if err != nil {
+		panic(errors.Wrapf(err, "converting shape %d", n))
+	}
+	var name string
+	if sr.nameIdx >= 0 {
+		name = sr.r.ReadAttribute(n, sr.nameIdx)
+	}
+	rd := road{idx: sr.i, name: name, geom: geom}
+	sr.i++
+	return rd, true
+}
+
+func llFromShpPoint(p shp.Point) s2.LatLng {
+	return s2.LatLngFromDegrees(p.Y, p.X)
+}
+
+func llsFromShpPoints(pts []shp.Point) []s2.LatLng {
+	lls := make([]s2.LatLng, len(pts))
+	for i, p := range pts {
+		lls[i] = llFromShpPoint(p)
+	}
+	return lls
+}
+
+// splitShapeParts breaks a shapefile PolyLine/Polygon's flat Points array
+// into its Parts, the shapefile equivalent of WKT's MULTILINESTRING groups.
+func splitShapeParts(points []shp.Point, parts []int32) [][]shp.Point {
+	out := make([][]shp.Point, len(parts))
+	for i := range parts {
+		start := parts[i]
+		end := int32(len(points))
+		if i+1 < len(parts) {
+			end = parts[i+1]
+		}
+		out[i] = points[start:end]
+	}
+	return out
+}
+
+func geometryFromShape(shape shp.Shape) (Geometry, error) {
+	switch s := shape.(type) {
+	case *shp.Point:
+		ll := llFromShpPoint(*s)
+		return &parsedGeometry{
+			regions: []s2.Region{s2.PointFromLatLng(ll)},
+			center:  ll,
+			wkb:     encodePointWKB(ll),
+		}, nil
+
+	case *shp.PolyLine:
+		parts := splitShapeParts(s.Points, s.Parts)
+		var allLLs [][]s2.LatLng
+		for _, part := range parts {
+			allLLs = append(allLLs, llsFromShpPoints(part))
+		}
+		g := &parsedGeometry{center: allLLs[0][0], wkb: encodeMultiLineStringWKB(allLLs)}
+		for _, lls := range allLLs {
+			g.regions = append(g.regions, s2.PolylineFromLatLngs(lls))
+		}
+		return g, nil
+
+	case *shp.Polygon:
+		parts := splitShapeParts(s.Points, s.Parts)
+		var rings [][]s2.LatLng
+		for _, part := range parts {
+			rings = append(rings, llsFromShpPoints(part))
+		}
+		poly, center := polygonFromRings(rings)
+		return &parsedGeometry{
+			regions: []s2.Region{poly},
+			center:  center,
+			wkb:     encodePolygonWKB(rings),
+		}, nil
+
+	case *shp.MultiPoint:
+		lls := llsFromShpPoints(s.Points)
+		g := &parsedGeometry{center: lls[0], wkb: encodeMultiPointWKB(lls)}
+		for _, ll := range lls {
+			g.regions = append(g.regions, s2.PointFromLatLng(ll))
+		}
+		return g, nil
+
+	default:
+		return nil, errors.Errorf("unsupported shapefile geometry type: %T", shape)
+	}
+}